@@ -0,0 +1,175 @@
+package bslack
+
+import (
+	"sync"
+	"time"
+
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/nlopes/slack"
+	"github.com/sirupsen/logrus"
+)
+
+// Slack message subtypes we special-case while shaping received messages.
+const (
+	sMessageDeleted = "message_deleted"
+	sFileComment    = "file_comment"
+)
+
+// outgoingWebhookConfig holds the incoming-webhook URL used for posting, if any;
+// when it's set we skip resolving bot messages against the Slack API ourselves.
+const outgoingWebhookConfig = "WebhookURL"
+
+// Bslack is the Slack bridge implementation. It keeps local caches of users,
+// channels and direct conversations so that the hot message-routing path does
+// not have to look users or channels up through the Slack API.
+type Bslack struct {
+	Account      string
+	useChannelID bool
+
+	Log      *logrus.Entry
+	settings map[string]interface{}
+
+	// Remote is where fully-populated messages are handed off to the router.
+	Remote chan config.Message
+
+	sc  *slack.Client
+	rtm *slack.RTM
+
+	usersMutex sync.RWMutex
+	users      map[string]*slack.User
+
+	channelsMutex  sync.RWMutex
+	channelsByID   map[string]*slack.Channel
+	channelsByName map[string]*slack.Channel
+
+	// threadCacheMutex guards threadCache, the ThreadCache used to post replies
+	// into the right Slack thread. It's per-account for the same reason as the
+	// maps above: the Slack thread_ts namespace is scoped to a single workspace.
+	threadCacheMutex sync.RWMutex
+	threadCache      map[string]threadCacheEntry
+
+	// dmMutex guards the IM/MPIM indexes. These are per-account, like the maps
+	// above: matterbridge can run several Slack accounts in one process, and a
+	// package-level map would let one account's DM routing leak into another's.
+	dmMutex   sync.RWMutex
+	imsByUser map[string]*slack.Channel // keyed by the other party's user ID
+	mpimsByID map[string]*slack.Channel // keyed by the MPIM's own channel ID
+	dmByName  map[string]*slack.Channel // keyed by the synthetic "@..." name
+	dmByID    map[string]*slack.Channel // keyed by channel ID, for getChannelByID
+
+	// refreshMutex guards earliest{User,Channel}Refresh, which throttle
+	// populateUsers/populateChannels independently of the per-account event
+	// stream: the RTM dispatcher is the primary update path now, but anything
+	// that still calls these directly (reconnects, manual refresh requests)
+	// must not be able to hammer users.list/conversations.list back to back.
+	refreshMutex           sync.Mutex
+	earliestUserRefresh    time.Time
+	earliestChannelRefresh time.Time
+
+	done chan struct{}
+}
+
+// GetString returns the string value of the named account setting, or "" if unset.
+func (b *Bslack) GetString(key string) string {
+	if v, ok := b.settings[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// GetBool returns the bool value of the named account setting, or false if unset.
+func (b *Bslack) GetBool(key string) bool {
+	if v, ok := b.settings[key].(bool); ok {
+		return v
+	}
+	return false
+}
+
+// Connect opens the RTM connection and starts the background goroutines that
+// keep the user/channel/thread caches current for as long as the connection
+// lives: the RTM event loop (which applies incremental updates via
+// handleConnectorEvent) and the cold-start/hourly cache reconciliation loop.
+func (b *Bslack) Connect() error {
+	// Initialize the caches before any goroutine can reach them: RTM events can
+	// arrive (and handleConnectorEvent can try to write into them) before the
+	// first populateUsers/populateChannels pagination completes, or even if it
+	// never does because the initial users.list/conversations.list call errors
+	// out. Writing into a nil map panics, so these must exist up front.
+	b.usersMutex.Lock()
+	b.users = map[string]*slack.User{}
+	b.usersMutex.Unlock()
+
+	b.channelsMutex.Lock()
+	b.channelsByID = map[string]*slack.Channel{}
+	b.channelsByName = map[string]*slack.Channel{}
+	b.channelsMutex.Unlock()
+
+	b.dmMutex.Lock()
+	b.imsByUser = map[string]*slack.Channel{}
+	b.mpimsByID = map[string]*slack.Channel{}
+	b.dmByName = map[string]*slack.Channel{}
+	b.dmByID = map[string]*slack.Channel{}
+	b.dmMutex.Unlock()
+
+	b.rtm = b.sc.NewRTM()
+	go b.rtm.ManageConnection()
+
+	b.done = make(chan struct{})
+	go b.startCacheReconciliationLoop(b.done)
+	go b.startThreadCacheEvictionLoop(b.done)
+	go b.handleSlackEvents()
+
+	return nil
+}
+
+// Disconnect tears down the RTM connection and stops the reconciliation loop.
+func (b *Bslack) Disconnect() error {
+	close(b.done)
+	return b.rtm.Disconnect()
+}
+
+// handleSlackEvents is the main RTM receive loop. Events handleConnectorEvent
+// recognizes are applied as targeted cache mutations; message events are
+// shaped into a config.Message and handed off to the router, and any other
+// event is ignored.
+func (b *Bslack) handleSlackEvents() {
+	for msg := range b.rtm.IncomingEvents {
+		if b.handleConnectorEvent(msg) {
+			continue
+		}
+
+		switch ev := msg.Data.(type) {
+		case *slack.MessageEvent:
+			rmsg, err := b.populateReceivedMessage(ev)
+			if err != nil {
+				b.Log.Errorf("Could not process message: %#v", err)
+				continue
+			}
+			b.Remote <- *rmsg
+		}
+	}
+}
+
+// Send posts msg to the Slack channel it targets. When msg.ParentID resolves to
+// a thread we've seen before (via ThreadCache), it's posted as a reply in that
+// thread instead of a flat channel message.
+func (b *Bslack) Send(msg config.Message) (string, error) {
+	channel, err := b.getChannel(msg.Channel)
+	if err != nil {
+		return "", err
+	}
+	b.Log.Debugf("Posting message to %s %s", channelKind(channel), channel.Name)
+
+	opts := append([]slack.MsgOption{slack.MsgOptionText(msg.Text, false)}, b.threadMsgOptions(&msg)...)
+	_, ts, err := b.sc.PostMessage(channel.ID, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	threadTS := ts
+	if parentTS, ok := b.lookupThread(msg.ParentID); ok {
+		threadTS = parentTS
+	}
+	b.rememberThread(msg.ID, threadTS)
+	return ts, nil
+}
@@ -0,0 +1,174 @@
+package bslack
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// cacheSchemaVersion guards against loading a cache file written by an
+// incompatible version of this code; bump it whenever diskCache's shape changes.
+const cacheSchemaVersion = 1
+
+// cachePathConfig points at the file the user, channel and direct-conversation
+// caches are warmed from on startup (loadCacheFromDisk) and persisted to after
+// each reconciliation (saveCacheToDisk). Caching is disabled when unset.
+const cachePathConfig = "CachePath"
+
+// cacheMaxAgeConfig bounds how stale an on-disk cache may be before we discard it
+// rather than route messages against badly outdated data. A Go duration string,
+// e.g. "24h". Unset or zero means no limit.
+const cacheMaxAgeConfig = "CacheMaxAge"
+
+// diskCache is the on-disk representation of everything populateUsers,
+// populateChannels and populateDirectConversations keep in memory.
+type diskCache struct {
+	Version       int
+	LastRefreshed time.Time
+	Users         map[string]*slack.User
+	Channels      []*slack.Channel
+	IMs           map[string]*slack.Channel
+	MPIMs         map[string]*slack.Channel
+}
+
+func (b *Bslack) cacheMaxAge() time.Duration {
+	raw := b.GetString(cacheMaxAgeConfig)
+	if raw == "" {
+		return 0
+	}
+	maxAge, err := time.ParseDuration(raw)
+	if err != nil {
+		b.Log.Errorf("Invalid %s %q: %#v", cacheMaxAgeConfig, raw, err)
+		return 0
+	}
+	return maxAge
+}
+
+// loadCacheFromDisk warms the user, channel and direct-conversation caches from
+// CachePath, if configured, so the bridge can begin routing messages immediately
+// instead of waiting on a full users.list/conversations.list pagination.
+func (b *Bslack) loadCacheFromDisk() {
+	path := b.GetString(cachePathConfig)
+	if path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.Log.Errorf("Could not read cache file %s: %#v", path, err)
+		}
+		return
+	}
+
+	var cache diskCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		b.Log.Errorf("Could not parse cache file %s: %#v", path, err)
+		return
+	}
+	if cache.Version != cacheSchemaVersion {
+		b.Log.Infof("Ignoring cache file %s: schema version %d, want %d", path, cache.Version, cacheSchemaVersion)
+		return
+	}
+	if maxAge := b.cacheMaxAge(); maxAge > 0 && time.Since(cache.LastRefreshed) > maxAge {
+		b.Log.Infof("Ignoring cache file %s: last refreshed %s ago, older than %s", path, time.Since(cache.LastRefreshed), maxAge)
+		return
+	}
+
+	b.usersMutex.Lock()
+	b.users = cache.Users
+	b.usersMutex.Unlock()
+
+	newChannelsByID := map[string]*slack.Channel{}
+	newChannelsByName := map[string]*slack.Channel{}
+	for _, channel := range cache.Channels {
+		newChannelsByID[channel.ID] = channel
+		newChannelsByName[channel.Name] = channel
+	}
+	b.channelsMutex.Lock()
+	b.channelsByID = newChannelsByID
+	b.channelsByName = newChannelsByName
+	b.channelsMutex.Unlock()
+
+	newDMByName := map[string]*slack.Channel{}
+	newDMByID := map[string]*slack.Channel{}
+	for _, channel := range cache.IMs {
+		newDMByName[channel.Name] = channel
+		newDMByID[channel.ID] = channel
+	}
+	for _, channel := range cache.MPIMs {
+		newDMByName[channel.Name] = channel
+		newDMByID[channel.ID] = channel
+	}
+	b.dmMutex.Lock()
+	b.imsByUser = cache.IMs
+	b.mpimsByID = cache.MPIMs
+	b.dmByName = newDMByName
+	b.dmByID = newDMByID
+	b.dmMutex.Unlock()
+
+	b.Log.Infof("Warmed caches from %s (last refreshed %s ago); reconciling in the background.", path, time.Since(cache.LastRefreshed))
+}
+
+// saveCacheToDisk writes the current user, channel and direct-conversation
+// caches to CachePath, if configured, so the next restart can warm-start from
+// them instead of burning Slack rate-limit budget on a cold users.list/
+// conversations.list pagination.
+func (b *Bslack) saveCacheToDisk() {
+	path := b.GetString(cachePathConfig)
+	if path == "" {
+		return
+	}
+
+	b.usersMutex.RLock()
+	users := make(map[string]*slack.User, len(b.users))
+	for id, user := range b.users {
+		users[id] = user
+	}
+	b.usersMutex.RUnlock()
+
+	b.channelsMutex.RLock()
+	channels := make([]*slack.Channel, 0, len(b.channelsByID))
+	for _, channel := range b.channelsByID {
+		channels = append(channels, channel)
+	}
+	b.channelsMutex.RUnlock()
+
+	b.dmMutex.RLock()
+	ims := make(map[string]*slack.Channel, len(b.imsByUser))
+	for id, channel := range b.imsByUser {
+		ims[id] = channel
+	}
+	mpims := make(map[string]*slack.Channel, len(b.mpimsByID))
+	for id, channel := range b.mpimsByID {
+		mpims[id] = channel
+	}
+	b.dmMutex.RUnlock()
+
+	cache := diskCache{
+		Version:       cacheSchemaVersion,
+		LastRefreshed: time.Now(),
+		Users:         users,
+		Channels:      channels,
+		IMs:           ims,
+		MPIMs:         mpims,
+	}
+
+	data, err := json.Marshal(cache)
+	if err != nil {
+		b.Log.Errorf("Could not serialize cache: %#v", err)
+		return
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0o600); err != nil {
+		b.Log.Errorf("Could not write cache file %s: %#v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		b.Log.Errorf("Could not replace cache file %s: %#v", path, err)
+	}
+}
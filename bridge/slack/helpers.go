@@ -3,8 +3,8 @@ package bslack
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/42wim/matterbridge/bridge/config"
@@ -36,14 +36,50 @@ func (b *Bslack) getAvatar(id string) string {
 	return ""
 }
 
+// getChannel is the single entry point outgoing message routing uses to
+// resolve a matterbridge channel reference to a Slack channel. Beyond the
+// ID:/name lookup, it enforces the DM ACL at resolution time via
+// enforceDirectMessageACL; populateReceivedMessage applies the same check on
+// the incoming side, so disabling a user's DM access takes effect immediately
+// in both directions rather than waiting for the next
+// populateDirectConversations sweep to drop it from the cache.
 func (b *Bslack) getChannel(channel string) (*slack.Channel, error) {
+	var (
+		resolved *slack.Channel
+		err      error
+	)
 	if strings.HasPrefix(channel, "ID:") {
-		return b.getChannelByID(strings.TrimPrefix(channel, "ID:"))
+		resolved, err = b.getChannelByID(strings.TrimPrefix(channel, "ID:"))
+	} else {
+		resolved, err = b.getChannelByName(channel)
 	}
-	return b.getChannelByName(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.enforceDirectMessageACL(resolved); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// enforceDirectMessageACL rejects an IM or MPIM channel that DMRegexp no
+// longer permits. It's shared by getChannel (outgoing) and
+// populateReceivedMessage (incoming) so that tightening DMRegexp takes effect
+// on both paths at once, not just on whichever one happens to re-resolve the
+// channel first.
+func (b *Bslack) enforceDirectMessageACL(channel *slack.Channel) error {
+	if (isIM(channel) || isMPIM(channel)) && !b.directMessageAllowed(channel) {
+		return fmt.Errorf("%s: direct messages with %s are not enabled by %s", b.Account, channel.Name, dmRegexpConfig)
+	}
+	return nil
 }
 
 func (b *Bslack) getChannelByName(name string) (*slack.Channel, error) {
+	if strings.HasPrefix(name, "@") {
+		return b.getDirectChannelByName(strings.TrimPrefix(name, "@"))
+	}
+
 	b.channelsMutex.RLock()
 	defer b.channelsMutex.RUnlock()
 
@@ -55,32 +91,180 @@ func (b *Bslack) getChannelByName(name string) (*slack.Channel, error) {
 
 func (b *Bslack) getChannelByID(ID string) (*slack.Channel, error) {
 	b.channelsMutex.RLock()
-	defer b.channelsMutex.RUnlock()
+	channel, ok := b.channelsByID[ID]
+	b.channelsMutex.RUnlock()
+	if ok {
+		return channel, nil
+	}
 
-	if channel, ok := b.channelsByID[ID]; ok {
+	b.dmMutex.RLock()
+	defer b.dmMutex.RUnlock()
+	if channel, ok := b.dmByID[ID]; ok {
 		return channel, nil
 	}
 	return nil, fmt.Errorf("%s: channel %s not found", b.Account, ID)
 }
 
-const minimumRefreshInterval = 10 * time.Second
+// getDirectChannelByName resolves the synthetic "@user" (IM) and "@user1,user2"
+// (MPIM) names we hand out in place of the nameless channels Slack gives IMs and
+// MPIMs back to their underlying *slack.Channel.
+func (b *Bslack) getDirectChannelByName(name string) (*slack.Channel, error) {
+	b.dmMutex.RLock()
+	defer b.dmMutex.RUnlock()
 
-var (
-	refreshMutex           sync.Mutex
-	refreshInProgress      bool
-	earliestChannelRefresh = time.Now()
-	earliestUserRefresh    = time.Now()
-)
+	if channel, ok := b.dmByName["@"+name]; ok {
+		return channel, nil
+	}
+	return nil, fmt.Errorf("%s: direct channel @%s not found", b.Account, name)
+}
+
+// threadBroadcastConfig toggles whether thread replies are also broadcast to the
+// parent channel, mirroring Slack's own "also send to #channel" checkbox.
+const threadBroadcastConfig = "PrefixMessagesWithThreadBroadcast"
+
+// threadCacheTTL bounds how long we remember the Slack thread a matterbridge
+// message belongs to. Beyond that we simply post a fresh, un-threaded message
+// rather than keep growing the cache forever.
+const threadCacheTTL = 48 * time.Hour
+
+type threadCacheEntry struct {
+	threadTS string
+	addedAt  time.Time
+}
+
+// threadCacheEvictionInterval governs how often evictExpiredThreads sweeps the
+// ThreadCache for entries older than threadCacheTTL. Eviction runs on its own
+// timer rather than on every rememberThread call, since a busy bridge calls
+// rememberThread for every single message it relays.
+const threadCacheEvictionInterval = 10 * time.Minute
+
+// rememberThread records the Slack thread_ts that the matterbridge message msgID
+// belongs to, so that later replies to msgID can be posted into the same thread.
+// Expired entries are swept out separately by evictExpiredThreads.
+func (b *Bslack) rememberThread(msgID, threadTS string) {
+	if msgID == "" || threadTS == "" {
+		return
+	}
+
+	b.threadCacheMutex.Lock()
+	defer b.threadCacheMutex.Unlock()
+
+	if b.threadCache == nil {
+		b.threadCache = map[string]threadCacheEntry{}
+	}
+	b.threadCache[msgID] = threadCacheEntry{threadTS: threadTS, addedAt: time.Now()}
+}
+
+// evictExpiredThreads sweeps the ThreadCache for entries older than
+// threadCacheTTL. It's meant to be called periodically rather than per message.
+func (b *Bslack) evictExpiredThreads() {
+	b.threadCacheMutex.Lock()
+	defer b.threadCacheMutex.Unlock()
+
+	for id, entry := range b.threadCache {
+		if time.Since(entry.addedAt) > threadCacheTTL {
+			delete(b.threadCache, id)
+		}
+	}
+}
+
+// startThreadCacheEvictionLoop periodically evicts expired ThreadCache entries
+// until done is closed. It's meant to be started once per connection, alongside
+// the cache reconciliation loop.
+func (b *Bslack) startThreadCacheEvictionLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(threadCacheEvictionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.evictExpiredThreads()
+		case <-done:
+			return
+		}
+	}
+}
+
+// lookupThread returns the Slack thread_ts a previously seen matterbridge message
+// belongs to, if we still remember it.
+func (b *Bslack) lookupThread(msgID string) (string, bool) {
+	b.threadCacheMutex.RLock()
+	defer b.threadCacheMutex.RUnlock()
+
+	entry, ok := b.threadCache[msgID]
+	if !ok || time.Since(entry.addedAt) > threadCacheTTL {
+		return "", false
+	}
+	return entry.threadTS, true
+}
+
+// threadMsgOptions returns the slack.MsgOption values needed to post msg as a
+// reply in an existing thread, or nil if msg isn't part of one we know about.
+func (b *Bslack) threadMsgOptions(msg *config.Message) []slack.MsgOption {
+	if msg.ParentID == "" {
+		return nil
+	}
+	threadTS, ok := b.lookupThread(msg.ParentID)
+	if !ok {
+		return nil
+	}
+
+	opts := []slack.MsgOption{slack.MsgOptionTS(threadTS)}
+	if b.GetBool(threadBroadcastConfig) {
+		opts = append(opts, slack.MsgOptionBroadcast())
+	}
+	return opts
+}
+
+// reconciliationInterval governs how often we fall back to a full populateUsers
+// / populateChannels refresh. Now that the RTM dispatcher keeps the caches up to
+// date event by event, this only needs to paper over events we might have missed
+// (e.g. during a reconnect), not act as the primary update path.
+const reconciliationInterval = time.Hour
+
+// startCacheReconciliationLoop runs populateUsers and populateChannels once, then
+// again every reconciliationInterval, until done is closed. It's meant to be
+// started once per connection, alongside the RTM event handlers that keep the
+// caches current in between reconciliations.
+func (b *Bslack) startCacheReconciliationLoop(done <-chan struct{}) {
+	// A warm, on-disk cache lets us start routing messages on stale-but-usable
+	// data immediately, rather than blocking on the full users.list/
+	// conversations.list pagination every restart.
+	b.loadCacheFromDisk()
+
+	refresh := func() {
+		b.populateUsers()
+		b.populateChannels()
+		b.populateDirectConversations()
+		b.saveCacheToDisk()
+	}
+	go refresh()
+
+	ticker := time.NewTicker(reconciliationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			refresh()
+		case <-done:
+			return
+		}
+	}
+}
+
+// minimumRefreshInterval bounds how often a single Bslack instance will refetch
+// the whole user or channel list, regardless of how often populateUsers /
+// populateChannels gets called.
+const minimumRefreshInterval = 10 * time.Second
 
 func (b *Bslack) populateUsers() {
-	refreshMutex.Lock()
-	if time.Now().Before(earliestUserRefresh) || refreshInProgress {
+	b.refreshMutex.Lock()
+	if time.Now().Before(b.earliestUserRefresh) {
 		b.Log.Debugf("Not refreshing user list as it was done less than %d seconds ago.", int(minimumRefreshInterval.Seconds()))
-		refreshMutex.Unlock()
+		b.refreshMutex.Unlock()
 		return
 	}
-	refreshInProgress = true
-	refreshMutex.Unlock()
+	b.earliestUserRefresh = time.Now().Add(minimumRefreshInterval)
+	b.refreshMutex.Unlock()
 
 	users, err := b.sc.GetUsers()
 	if err != nil {
@@ -98,26 +282,23 @@ func (b *Bslack) populateUsers() {
 	b.usersMutex.Lock()
 	defer b.usersMutex.Unlock()
 	b.users = newUsers
-
-	earliestUserRefresh = time.Now().Add(minimumRefreshInterval)
-	refreshInProgress = false
 }
 
 func (b *Bslack) populateChannels() {
-	refreshMutex.Lock()
-	if time.Now().Before(earliestChannelRefresh) || refreshInProgress {
+	b.refreshMutex.Lock()
+	if time.Now().Before(b.earliestChannelRefresh) {
 		b.Log.Debugf("Not refreshing channel list as it was done less than %d seconds ago.", int(minimumRefreshInterval.Seconds()))
-		refreshMutex.Unlock()
+		b.refreshMutex.Unlock()
 		return
 	}
-	refreshInProgress = true
-	refreshMutex.Unlock()
+	b.earliestChannelRefresh = time.Now().Add(minimumRefreshInterval)
+	b.refreshMutex.Unlock()
 
 	newChannelsByID := map[string]*slack.Channel{}
 	newChannelsByName := map[string]*slack.Channel{}
 
-	// We only retrieve public and private channels, not IMs
-	// and MPIMs as those do not have a channel name.
+	// IMs and MPIMs are handled separately by populateDirectConversations, since
+	// Slack gives them no channel name of their own.
 	queryParams := &slack.GetConversationsParameters{
 		ExcludeArchived: "true",
 		Types:           []string{"public_channel,private_channel"},
@@ -142,9 +323,297 @@ func (b *Bslack) populateChannels() {
 	defer b.channelsMutex.Unlock()
 	b.channelsByID = newChannelsByID
 	b.channelsByName = newChannelsByName
+}
+
+// isPublicChannel, isPrivateChannel, isIM and isMPIM classify a *slack.Channel
+// explicitly instead of relying on name lookups. Slack has unified channels and
+// groups, so a private conversation can report IsChannel=true and IsPrivate=true
+// rather than IsGroup=true; checking IsChannel alone would misclassify it.
+func isPublicChannel(channel *slack.Channel) bool {
+	return channel.IsChannel && !channel.IsPrivate
+}
+
+func isPrivateChannel(channel *slack.Channel) bool {
+	return (channel.IsGroup || channel.IsChannel) && channel.IsPrivate
+}
+
+func isIM(channel *slack.Channel) bool {
+	return channel.IsIM
+}
+
+func isMPIM(channel *slack.Channel) bool {
+	return channel.IsMpIM
+}
+
+// channelKind classifies channel using the predicates above, for logging and ACL
+// decisions that need to know what they're dealing with.
+func channelKind(channel *slack.Channel) string {
+	switch {
+	case isIM(channel):
+		return "im"
+	case isMPIM(channel):
+		return "mpim"
+	case isPrivateChannel(channel):
+		return "private channel"
+	case isPublicChannel(channel):
+		return "public channel"
+	default:
+		return "unknown"
+	}
+}
+
+// dmRegexpConfig whitelists which users' IMs and MPIMs get pulled in and forwarded,
+// so that a misconfigured gateway doesn't accidentally leak every private chat on
+// the team. An empty pattern matches nobody.
+const dmRegexpConfig = "DMRegexp"
+
+// directMessageRegexp compiles the DMRegexp config knob, if any. A nil result
+// means no IMs or MPIMs should be forwarded.
+func (b *Bslack) directMessageRegexp() *regexp.Regexp {
+	pattern := b.GetString(dmRegexpConfig)
+	if pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		b.Log.Errorf("Invalid %s %q: %#v", dmRegexpConfig, pattern, err)
+		return nil
+	}
+	return re
+}
+
+// directMessageAllowed reports whether channel (an IM or MPIM, per isIM/isMPIM)
+// is still permitted by the current DMRegexp. For an MPIM, any one member
+// matching is enough, mirroring the populate-time filter in
+// populateDirectConversations.
+func (b *Bslack) directMessageAllowed(channel *slack.Channel) bool {
+	dmRegexp := b.directMessageRegexp()
+	if dmRegexp == nil {
+		return false
+	}
+
+	if isIM(channel) {
+		user := b.getUser(channel.User)
+		return user != nil && dmRegexp.MatchString(user.Name)
+	}
+
+	for _, name := range strings.Split(strings.TrimPrefix(channel.Name, "@"), ",") {
+		if dmRegexp.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// directChannelName returns the synthetic channel name we use in place of the
+// name-less channel Slack hands back for a 1:1 IM with user.
+func directChannelName(user *slack.User) string {
+	return "@" + user.Name
+}
 
-	earliestChannelRefresh = time.Now().Add(minimumRefreshInterval)
-	refreshInProgress = false
+// mpimChannelName returns the synthetic channel name we use in place of the
+// name-less channel Slack hands back for a multi-party IM between usernames.
+func mpimChannelName(usernames []string) string {
+	sorted := append([]string(nil), usernames...)
+	sort.Strings(sorted)
+	return "@" + strings.Join(sorted, ",")
+}
+
+// populateDirectConversations fetches the IMs and MPIMs the bot is a party to and
+// indexes them so they can be referenced as routable channels, subject to
+// DMRegexp. Unlike populateChannels these carry no name from Slack, so we
+// synthesize one from the member usernames.
+func (b *Bslack) populateDirectConversations() {
+	dmRegexp := b.directMessageRegexp()
+	if dmRegexp == nil {
+		b.Log.Debug("DMRegexp is unset, not forwarding any IMs or MPIMs.")
+		// Clear anything a previous reconcile (or a cache warmed from disk by
+		// loadCacheFromDisk) may have populated, so disabling DMRegexp takes
+		// effect immediately instead of leaving stale DMs routable.
+		b.dmMutex.Lock()
+		b.imsByUser = map[string]*slack.Channel{}
+		b.mpimsByID = map[string]*slack.Channel{}
+		b.dmByName = map[string]*slack.Channel{}
+		b.dmByID = map[string]*slack.Channel{}
+		b.dmMutex.Unlock()
+		return
+	}
+
+	newIMsByUser := map[string]*slack.Channel{}
+	newMPIMsByID := map[string]*slack.Channel{}
+	newDMByName := map[string]*slack.Channel{}
+	newDMByID := map[string]*slack.Channel{}
+
+	queryParams := &slack.GetConversationsParameters{
+		ExcludeArchived: "true",
+		Types:           []string{"im,mpim"},
+	}
+	for {
+		channels, nextCursor, err := b.sc.GetConversations(queryParams)
+		if err != nil {
+			b.Log.Errorf("Could not reload direct conversations: %#v", err)
+			return
+		}
+		for i := range channels {
+			channel := &channels[i]
+			switch {
+			case isIM(channel):
+				user := b.getUser(channel.User)
+				if user == nil || !dmRegexp.MatchString(user.Name) {
+					continue
+				}
+				channel.Name = directChannelName(user)
+				newIMsByUser[channel.User] = channel
+				newDMByName[channel.Name] = channel
+				newDMByID[channel.ID] = channel
+			case isMPIM(channel):
+				members, _, err := b.sc.GetUsersInConversation(&slack.GetUsersInConversationParameters{ChannelID: channel.ID})
+				if err != nil {
+					b.Log.Errorf("Could not fetch members of MPIM %s: %#v", channel.ID, err)
+					continue
+				}
+				usernames := make([]string, 0, len(members))
+				allowed := false
+				for _, memberID := range members {
+					user := b.getUser(memberID)
+					if user == nil {
+						continue
+					}
+					usernames = append(usernames, user.Name)
+					allowed = allowed || dmRegexp.MatchString(user.Name)
+				}
+				if !allowed {
+					continue
+				}
+				channel.Name = mpimChannelName(usernames)
+				newMPIMsByID[channel.ID] = channel
+				newDMByName[channel.Name] = channel
+				newDMByID[channel.ID] = channel
+			}
+		}
+		if nextCursor == "" {
+			break
+		}
+		queryParams.Cursor = nextCursor
+	}
+
+	b.dmMutex.Lock()
+	defer b.dmMutex.Unlock()
+	b.imsByUser = newIMsByUser
+	b.mpimsByID = newMPIMsByID
+	b.dmByName = newDMByName
+	b.dmByID = newDMByID
+}
+
+// handleConnectorEvent applies the incremental RTM events we know how to turn
+// into a targeted cache mutation, so that a single user or channel change no
+// longer requires refetching the whole workspace. It reports whether it handled
+// the event; events it doesn't recognize are left for the reconciliation loop.
+func (b *Bslack) handleConnectorEvent(event slack.RTMEvent) bool {
+	switch ev := event.Data.(type) {
+	case *slack.UserChangeEvent:
+		b.handleUserChangeEvent(ev)
+	case *slack.TeamJoinEvent:
+		b.handleTeamJoinEvent(ev)
+	case *slack.ChannelCreatedEvent:
+		b.handleChannelCreatedEvent(ev)
+	case *slack.ChannelRenameEvent:
+		b.handleChannelRenameEvent(ev)
+	case *slack.ChannelArchiveEvent:
+		b.handleChannelArchiveEvent(ev)
+	case *slack.ChannelUnarchiveEvent:
+		b.handleChannelUnarchiveEvent(ev)
+	case *slack.GroupRenameEvent:
+		b.handleGroupRenameEvent(ev)
+	case *slack.MemberJoinedChannelEvent:
+		b.handleMemberJoinedChannelEvent(ev)
+	default:
+		return false
+	}
+	return true
+}
+
+func (b *Bslack) handleUserChangeEvent(ev *slack.UserChangeEvent) {
+	b.usersMutex.Lock()
+	defer b.usersMutex.Unlock()
+	b.users[ev.User.ID] = &ev.User
+}
+
+func (b *Bslack) handleTeamJoinEvent(ev *slack.TeamJoinEvent) {
+	b.usersMutex.Lock()
+	defer b.usersMutex.Unlock()
+	b.users[ev.User.ID] = &ev.User
+}
+
+// handleChannelCreatedEvent fetches the new channel's full info in the
+// background rather than on the caller's goroutine: handleConnectorEvent runs
+// on the single RTM receive loop, and a network round-trip (or rate-limit
+// backoff) there would stall relaying of every other message until it
+// returns. The hourly reconciliation loop would eventually pick the channel
+// up anyway; this just gets it indexed sooner.
+func (b *Bslack) handleChannelCreatedEvent(ev *slack.ChannelCreatedEvent) {
+	go func() {
+		channel, err := b.sc.GetConversationInfo(ev.Channel.ID, false)
+		if err != nil {
+			b.Log.Errorf("Could not fetch newly created channel %s: %#v", ev.Channel.ID, err)
+			return
+		}
+
+		b.channelsMutex.Lock()
+		defer b.channelsMutex.Unlock()
+		b.channelsByID[channel.ID] = channel
+		b.channelsByName[channel.Name] = channel
+	}()
+}
+
+func (b *Bslack) handleChannelRenameEvent(ev *slack.ChannelRenameEvent) {
+	b.channelsMutex.Lock()
+	defer b.channelsMutex.Unlock()
+
+	channel, ok := b.channelsByID[ev.Channel.ID]
+	if !ok {
+		return
+	}
+	delete(b.channelsByName, channel.Name)
+	channel.Name = ev.Channel.Name
+	b.channelsByName[channel.Name] = channel
+}
+
+func (b *Bslack) handleChannelArchiveEvent(ev *slack.ChannelArchiveEvent) {
+	b.channelsMutex.Lock()
+	defer b.channelsMutex.Unlock()
+
+	if channel, ok := b.channelsByID[ev.Channel]; ok {
+		channel.IsArchived = true
+	}
+}
+
+func (b *Bslack) handleChannelUnarchiveEvent(ev *slack.ChannelUnarchiveEvent) {
+	b.channelsMutex.Lock()
+	defer b.channelsMutex.Unlock()
+
+	if channel, ok := b.channelsByID[ev.Channel]; ok {
+		channel.IsArchived = false
+	}
+}
+
+func (b *Bslack) handleGroupRenameEvent(ev *slack.GroupRenameEvent) {
+	b.channelsMutex.Lock()
+	defer b.channelsMutex.Unlock()
+
+	channel, ok := b.channelsByID[ev.Channel.ID]
+	if !ok {
+		return
+	}
+	delete(b.channelsByName, channel.Name)
+	channel.Name = ev.Channel.Name
+	b.channelsByName[channel.Name] = channel
+}
+
+// handleMemberJoinedChannelEvent doesn't mutate our caches, since we don't track
+// channel membership; it only logs the join at debug level.
+func (b *Bslack) handleMemberJoinedChannelEvent(ev *slack.MemberJoinedChannelEvent) {
+	b.Log.Debugf("%s joined channel %s", ev.User, ev.Channel)
 }
 
 // populateReceivedMessage shapes the initial Matterbridge message that we will forward to the
@@ -155,6 +624,10 @@ func (b *Bslack) populateReceivedMessage(ev *slack.MessageEvent) (*config.Messag
 	if err != nil {
 		return nil, err
 	}
+	if err := b.enforceDirectMessageACL(channel); err != nil {
+		return nil, err
+	}
+	b.Log.Debugf("Relaying message from %s %s", channelKind(channel), channel.Name)
 
 	rmsg := &config.Message{
 		Text:    ev.Text,
@@ -170,9 +643,27 @@ func (b *Bslack) populateReceivedMessage(ev *slack.MessageEvent) (*config.Messag
 	if err = b.populateMessageWithUserInfo(ev, rmsg); err != nil {
 		return nil, err
 	}
+	b.populateThreadInfo(ev, rmsg)
 	return rmsg, err
 }
 
+// populateThreadInfo records the Slack thread this message belongs to (for a
+// top-level message, the thread its own timestamp would start) so that replies
+// to rmsg can later be posted into the same thread, and exposes the
+// parent relationship to other bridges via ParentID and Extra["slack_thread_ts"].
+func (b *Bslack) populateThreadInfo(ev *slack.MessageEvent, rmsg *config.Message) {
+	threadTS := ev.ThreadTimestamp
+	if threadTS == "" {
+		threadTS = ev.Timestamp
+	}
+	b.rememberThread(rmsg.ID, threadTS)
+
+	if ev.ThreadTimestamp != "" && ev.ThreadTimestamp != ev.Timestamp {
+		rmsg.ParentID = "slack " + ev.ThreadTimestamp
+		rmsg.Extra["slack_thread_ts"] = append(rmsg.Extra["slack_thread_ts"], ev.ThreadTimestamp)
+	}
+}
+
 func (b *Bslack) populateMessageWithUserInfo(ev *slack.MessageEvent, rmsg *config.Message) error {
 	if ev.SubType == sMessageDeleted || ev.SubType == sFileComment {
 		return nil